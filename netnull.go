@@ -7,31 +7,76 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
 	"flag"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"path"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	humanize "github.com/dustin/go-humanize"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	quic "github.com/quic-go/quic-go"
+
+	"github.com/andrelucas/netnull/pkg/toxic"
 )
 
 var blockSizeKilobytes = flag.Uint("blocksize", 256, "send blocksize in Kilobytes")
 var bytesDisplayFlag = flag.Bool("bytes", false,
 	"display results in bytes (normally shown in 'humanized' form)")
+var corruptRateFlag = flag.Float64("corrupt-rate", 0,
+	"when -framed is set, sender-side probability (0.0-1.0) of flipping a random bit\n"+
+		"\tin each frame's payload, to exercise the receiver's CRC validation path")
+var framedFlag = flag.Bool("framed", false,
+	"speak a framed protocol: a 4-byte length, a 4-byte CRC32C of the payload, then the\n"+
+		"\tpayload itself, instead of raw streaming")
+var frameSizeFlag = flag.Uint("frame-size", 4096,
+	"payload size in bytes for each frame when -framed is set")
 var halfClose = flag.Bool("halfclose", false,
 	"the unused direction of a send- or receive-only connection should be closed")
+var jitterFlag = flag.Duration("jitter", 0,
+	"random +/- delta applied on top of -latency")
+var latencyFlag = flag.Duration("latency", 0,
+	"delay added before every write on each connection")
 var listenAddr = flag.String("addr", "*", "server listen address")
 var listenPort = flag.Uint("port", 2021, "server listen port")
+var metricsAddr = flag.String("metrics-addr", "",
+	"if set, serve Prometheus metrics on this address (e.g. ':9100') at /metrics")
+var protoFlag = flag.String("proto", "tcp", "transport to listen on: tcp, udp, or quic")
+var rateLimitFlag = flag.Uint64("rate-limit", 0,
+	"cap each connection's throughput to this many bytes/sec (0 disables)")
 var receiveFlag = flag.Bool("receive", false,
 	"the server should receive data from clients")
 var sendFlag = flag.Bool("send", false, "the server should send data to clients")
+var sendFileFlag = flag.Bool("sendfile", false,
+	"stream -send-file to the client instead of writing netOutputData,\n"+
+		"\thashing it with SHA-256 as it goes so operators can verify what was sent")
+var sendFilePath = flag.String("send-file", "",
+	"path of the file to stream when -sendfile is set")
+var sendFileLoopFlag = flag.Bool("loop", false,
+	"when -sendfile is set, rewind the file on EOF and keep streaming instead of stopping")
+var udpIdleTimeout = flag.Duration("udp-idle-timeout", 5*time.Second,
+	"with -proto udp, how long a flow can go without a datagram before it's reaped and its rate reported")
 var verbose = flag.Bool("verbose", false, "print additional diagnostic information")
 var writeFileFlag = flag.Bool("write-file", false,
 	"write received data to the filesystem (dangerous!)")
@@ -63,6 +108,86 @@ func vprintf(format string, args ...interface{}) {
 
 var netOutputData []byte
 
+var (
+	// bytesReceivedTotal and bytesSentTotal are process-wide totals, not
+	// labelled by remote address: the remote includes an ephemeral client
+	// port, so a per-remote label would grow the registry by one series
+	// per connection ever seen - exactly the unbounded cardinality this
+	// endpoint exists to avoid. Per-connection detail stays in the
+	// existing log line at close.
+	bytesReceivedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netnull_bytes_received_total",
+		Help: "Total bytes received across all connections.",
+	})
+
+	bytesSentTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "netnull_bytes_sent_total",
+		Help: "Total bytes sent across all connections.",
+	})
+
+	connectionDurationSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "netnull_connection_duration_seconds",
+		Help:    "Duration of a connection from accept to close.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	activeConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "netnull_active_connections",
+		Help: "Number of connections currently being served.",
+	})
+
+	writeErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "netnull_write_errors_total",
+		Help: "Total write errors, labelled by error kind.",
+	}, []string{"kind"})
+)
+
+// serveMetrics starts the optional Prometheus /metrics endpoint. It
+// returns immediately; ListenAndServe runs in its own goroutine so a
+// bind failure there doesn't need to be threaded back through listen().
+func serveMetrics() {
+	if *metricsAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	iprintf("Serving Prometheus metrics on %s/metrics\n", *metricsAddr)
+	go func() {
+		if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+			log.Fatalf("Couldn't serve metrics on %s: %s", *metricsAddr, err)
+		}
+	}()
+}
+
+// writeErrorKind classifies a write error for the netnull_write_errors_total
+// label, distinguishing the everyday "remote went away" case from anything
+// more surprising.
+func writeErrorKind(err error) string {
+	if opErr, ok := err.(*net.OpError); ok && fmt.Sprint(opErr.Err) == "write: broken pipe" {
+		return "broken_pipe"
+	}
+	return "other"
+}
+
+// meteredWriter wraps an io.Writer, updating netnull_bytes_sent_total and
+// netnull_write_errors_total on every call, so io.Copy/io.CopyBuffer-driven
+// sends are reflected per iteration rather than only in the summary line
+// printed at close.
+type meteredWriter struct {
+	io.Writer
+}
+
+func (w *meteredWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if n > 0 {
+		bytesSentTotal.Add(float64(n))
+	}
+	if err != nil {
+		writeErrorsTotal.WithLabelValues(writeErrorKind(err)).Inc()
+	}
+	return n, err
+}
+
 func maybeHumanBytes(b uint64) string {
 	if !*bytesDisplayFlag {
 		return humanize.Bytes(b)
@@ -71,29 +196,50 @@ func maybeHumanBytes(b uint64) string {
 	}
 }
 
-func writeToChunkFile(file io.Writer, data *[]byte, size uint) {
-
+// bufferPool hands out blocksize-sized transfer buffers to readLoop and
+// writeLoop so that a busy server doesn't allocate one afresh per
+// connection. It's keyed on *blockSizeKilobytes, which is fixed for the
+// lifetime of the process, so every buffer it ever hands out is the same
+// size.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, (*blockSizeKilobytes)*1024)
+	},
 }
 
-func readLoop(conn net.Conn, wg *sync.WaitGroup) {
-
-	cinfo := fmt.Sprintf("[%s->%s] Input:", conn.RemoteAddr(), conn.LocalAddr())
-	var received uint64
-	var writeFile *os.File
-	var writeFileName string
-	var writeFileOffset uint64
-	var writeWrapCount uint
-	var writeFileSize uint64 = *writeFileChunkMB * uint64(1000*1000)
-
-	defer wg.Done()
+func getPooledBuffer() []byte {
+	buf := bufferPool.Get().([]byte)
+	if uint(len(buf)) != (*blockSizeKilobytes)*1024 {
+		// Flag changed under us (shouldn't happen in practice, flags are
+		// parsed once at startup) - don't hand back a mis-sized buffer.
+		return make([]byte, (*blockSizeKilobytes)*1024)
+	}
+	return buf
+}
 
-	data := make([]byte, (*blockSizeKilobytes)*1024)
+func putPooledBuffer(buf []byte) {
+	bufferPool.Put(buf)
+}
 
-	input := bufio.NewReader(conn)
+// receiveSink is an io.Writer that counts the bytes readLoop receives and,
+// if -write-file is set, persists them to a wrapping chunk file on the
+// filesystem.
+type receiveSink struct {
+	cinfo           string
+	received        uint64
+	writeFile       *os.File
+	writeFileName   string
+	writeFileOffset uint64
+	writeWrapCount  uint
+	writeFileSize   uint64
+}
 
-	start := time.Now()
+func newReceiveSink(cinfo string) *receiveSink {
+	s := &receiveSink{
+		cinfo:         cinfo,
+		writeFileSize: *writeFileChunkMB * uint64(1000*1000),
+	}
 
-	// Include the file creation in the timing - it might be relevant.
 	if *writeFileFlag {
 		vprintf("%s Attempting to open file write for prefix '%s'",
 			cinfo, *writeFilePath)
@@ -101,111 +247,362 @@ func readLoop(conn net.Conn, wg *sync.WaitGroup) {
 
 		var err error
 
-		writeFile, err = ioutil.TempFile(wfdir, wfprefix)
+		s.writeFile, err = ioutil.TempFile(wfdir, wfprefix)
 		if err != nil {
 			fmt.Fprint(os.Stderr, "%s Abort - tempfile create error: %s", cinfo, err)
-			return
+			return nil
 		}
-		writeFileName = writeFile.Name()
-		defer func() {
-			if writeFile != nil {
-				vprintf("%s Removing write file '%s'", cinfo, writeFileName)
-				os.Remove(writeFileName) // Ignore errors.
-			}
-		}()
+		s.writeFileName = s.writeFile.Name()
 		vprintf("%s will write to '%s' limiting its size to %v MB",
-			cinfo, writeFileName, *writeFileChunkMB)
+			cinfo, s.writeFileName, *writeFileChunkMB)
+	}
+
+	return s
+}
+
+func (s *receiveSink) Write(p []byte) (int, error) {
+	n := len(p)
+
+	if s.writeFile != nil {
+		if s.writeFileOffset+uint64(n) > s.writeFileSize {
+			s.writeFileOffset = 0
+			s.writeWrapCount++
+		}
+		vprintf("%s Attempt write %v bytes at offset %v", s.cinfo, n, s.writeFileOffset)
+		wn, err := s.writeFile.WriteAt(p, int64(s.writeFileOffset))
+		if err != nil {
+			return wn, fmt.Errorf("error writing to file '%s' at offset %v: %w",
+				s.writeFileName, s.writeFileOffset, err)
+		}
+		if wn != n {
+			// Short write.
+			return wn, fmt.Errorf("short write to file '%s' at offset %v (expected %v, got %v)",
+				s.writeFileName, s.writeFileOffset, n, wn)
+		}
+		s.writeFileOffset += uint64(n)
+	}
+
+	s.received += uint64(n)
+	bytesReceivedTotal.Add(float64(n))
+	vprintf("%s Received %d bytes\n", s.cinfo, n)
+	return n, nil
+}
+
+// close finalises the chunk file, if any was opened.
+func (s *receiveSink) close() {
+	if s.writeFile == nil {
+		return
 	}
+	vprintf("%s Closing write file, wrap count %d", s.cinfo, s.writeWrapCount)
+	s.writeFile.Close() // Ignore errors.
+	vprintf("%s Removing write file '%s'", s.cinfo, s.writeFileName)
+	os.Remove(s.writeFileName) // Ignore errors.
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// frameHeaderSize is the length of the length+CRC32C header in front of
+// every frame's payload in -framed mode.
+const frameHeaderSize = 8
+
+// readFramedLoop receives frames of a 4-byte big-endian length, a 4-byte
+// CRC32C of the payload, then the payload itself, validating the CRC of
+// each frame and reporting mismatches (count, first offset, and a hex
+// dump of the first bad payload on -verbose) when the connection closes. It
+// exists so corruption introduced by a middlebox or tunnel - which raw
+// streaming can't detect - shows up as a concrete, countable error.
+func readFramedLoop(conn net.Conn, wg *sync.WaitGroup) {
+
+	cinfo := fmt.Sprintf("[%s->%s] Input:", conn.RemoteAddr(), conn.LocalAddr())
+
+	defer wg.Done()
+
+	var received uint64
+	var frames uint64
+	var mismatches uint64
+	var firstMismatchOffset uint64
+	var haveMismatch bool
+	var firstMismatchDump string
+
+	header := make([]byte, frameHeaderSize)
+
+	start := time.Now()
 
 	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "%s error reading frame header: %s\n", cinfo, err)
+			}
+			break
+		}
 
-		n, err := input.Read(data)
+		length := binary.BigEndian.Uint32(header[0:4])
+		wantCRC := binary.BigEndian.Uint32(header[4:8])
 
-		if err == io.EOF {
-			// This is ok.
-			vprintf("%s Received EOF\n", cinfo)
+		if length > uint32(*frameSizeFlag) {
+			fmt.Fprintf(os.Stderr, "%s frame length %d exceeds -frame-size %d, treating as framing error\n",
+				cinfo, length, *frameSizeFlag)
 			break
-		} else if err != nil {
-			fmt.Fprintf(os.Stderr, "%s error: %s", cinfo, err)
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			fmt.Fprintf(os.Stderr, "%s error reading frame payload: %s\n", cinfo, err)
 			break
 		}
 
-		if *writeFileFlag {
-			if writeFileOffset+uint64(n) > writeFileSize {
-				writeFileOffset = uint64(0)
-				writeWrapCount++
-			}
-			vprintf("%s Attempt write %v bytes at offset %v", cinfo, n, writeFileOffset)
-			// Re-slice to the correct size.
-			writeData := data[:n]
-			wn, err := writeFile.WriteAt(writeData, int64(writeFileOffset))
-			if err != nil {
-				fmt.Fprintf(os.Stderr,
-					"%s Abort - error writing to file '%s' at offset %v: %s\n",
-					cinfo, writeFileName, writeFileOffset, err)
-				return
-			}
-			if wn != n {
-				// Short write.
-				fmt.Fprintf(os.Stderr,
-					"%s Abort - short write to file '%s' at offset %v (expected %v, got %v)\n",
-					cinfo, writeFileName, writeFileOffset, wn, n)
-				return
+		if gotCRC := crc32.Checksum(payload, crc32cTable); gotCRC != wantCRC {
+			mismatches++
+			if !haveMismatch {
+				firstMismatchOffset = received
+				haveMismatch = true
+				if *verbose {
+					firstMismatchDump = hex.Dump(payload)
+				}
 			}
-			writeFileOffset += uint64(n)
+			vprintf("%s CRC mismatch in frame %d at offset %d: want %08x got %08x",
+				cinfo, frames, received, wantCRC, gotCRC)
 		}
 
-		received += uint64(n)
-		vprintf("%s Received %d bytes\n", cinfo, n)
+		received += uint64(frameHeaderSize) + uint64(length)
+		frames++
+		bytesReceivedTotal.Add(float64(frameHeaderSize) + float64(length))
+	}
+
+	elapsed := time.Since(start)
+	rate := 1000.0 * float64(received) / float64(elapsed)
+
+	if mismatches > 0 {
+		iprintf("%s Received %s in %d frames, %s (%.3f MBps), %d CRC mismatches (first at offset %d)",
+			cinfo, maybeHumanBytes(received), frames, elapsed, rate, mismatches, firstMismatchOffset)
+		vprintf("%s First bad payload:\n%s", cinfo, firstMismatchDump)
+	} else {
+		iprintf("%s Received %s in %d frames, %s (%.3f MBps), no CRC mismatches",
+			cinfo, maybeHumanBytes(received), frames, elapsed, rate)
+	}
+}
+
+func readLoop(conn net.Conn, wg *sync.WaitGroup) {
+
+	if *framedFlag {
+		readFramedLoop(conn, wg)
+		return
+	}
+
+	cinfo := fmt.Sprintf("[%s->%s] Input:", conn.RemoteAddr(), conn.LocalAddr())
+
+	defer wg.Done()
+
+	buf := getPooledBuffer()
+	defer putPooledBuffer(buf)
+
+	start := time.Now()
+
+	// Include the file creation in the timing - it might be relevant.
+	sink := newReceiveSink(cinfo)
+	if sink == nil {
+		return
 	}
+	defer sink.close()
 
-	// Again, include the Close in the timing as it might matter.
-	if *writeFileFlag && writeFile != nil {
-		vprintf("%s Closing write file, wrap count %d", cinfo, writeWrapCount)
-		writeFile.Close() // Ignore errors.
+	// Hide conn's WriteTo (a *net.TCPConn has one) so io.CopyBuffer
+	// actually uses the pooled buffer instead of allocating its own.
+	_, err := io.CopyBuffer(sink, struct{ io.Reader }{conn}, buf)
+	if err != nil && err != io.EOF {
+		fmt.Fprintf(os.Stderr, "%s error: %s", cinfo, err)
 	}
+	vprintf("%s Received EOF\n", cinfo)
 
 	elapsed := time.Since(start)
 	// Convert: bytes -> MB (divide by 10^6), s -> ns (multiply by 10^9)
 	// => multiply by 10^3.
-	rate := 1000.0 * float64(received) / float64(elapsed)
+	rate := 1000.0 * float64(sink.received) / float64(elapsed)
 
-	iprintf("%s Received %s in %s (%.3f MBps)", cinfo, maybeHumanBytes(received), elapsed, rate)
+	iprintf("%s Received %s in %s (%.3f MBps)", cinfo, maybeHumanBytes(sink.received), elapsed, rate)
 }
 
-func writeLoop(conn net.Conn, wg *sync.WaitGroup) {
+// loopingFile wraps *os.File so that, when asked, it rewinds to the start
+// on EOF instead of ending the stream - useful for unattended continuous
+// throughput benchmarking off a single file.
+type loopingFile struct {
+	f    *os.File
+	loop bool
+}
+
+func (r *loopingFile) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	if err == io.EOF && r.loop {
+		if _, serr := r.f.Seek(0, io.SeekStart); serr != nil {
+			return n, serr
+		}
+		if n == 0 {
+			return r.f.Read(p)
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// sendFileLoop streams *sendFilePath to conn via io.Copy rather than
+// writing netOutputData. The source is wrapped for SHA-256 hashing (and
+// optionally looping) and the destination for byte-count metrics, so
+// this never takes the kernel's sendfile(2) fast path - it hashes the
+// bytes as they go so operators can check end-to-end integrity against
+// the source file.
+func sendFileLoop(conn net.Conn, wg *sync.WaitGroup) {
+
+	cinfo := fmt.Sprintf("[%s->%s] Output:", conn.RemoteAddr(), conn.LocalAddr())
+
+	defer wg.Done()
+
+	f, err := os.Open(*sendFilePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s Abort - error opening send file '%s': %s\n", cinfo, *sendFilePath, err)
+		return
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	reader := io.TeeReader(&loopingFile{f: f, loop: *sendFileLoopFlag}, hasher)
+	mw := &meteredWriter{Writer: conn}
+
+	start := time.Now()
+
+	sent, err := io.Copy(mw, reader)
+	if err != nil {
+		if writeErrorKind(err) == "broken_pipe" {
+			vprintf("%s Remote closed the connection", cinfo)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s error: %s\n", cinfo, err)
+		}
+	}
+
+	elapsed := time.Since(start)
+	rate := 1000.0 * float64(sent) / float64(elapsed)
+
+	iprintf("%s Sent %s in %s (%.3f MBps), sha256 %x",
+		cinfo, maybeHumanBytes(uint64(sent)), elapsed, rate, hasher.Sum(nil))
+}
+
+// repeatingReader is an io.Reader over netOutputData that cycles back to
+// the start of the buffer once exhausted, so it can be driven by
+// io.CopyBuffer as an endless source. It returns EOF only when data is
+// empty.
+type repeatingReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *repeatingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[r.pos:])
+	r.pos += n
+	if r.pos >= len(r.data) {
+		r.pos = 0
+	}
+	return n, nil
+}
+
+// writeFramedLoop is the -framed counterpart to writeLoop: it slices
+// netOutputData into -frame-size payloads and sends each as a 4-byte
+// big-endian length, a 4-byte CRC32C of the payload, then the payload,
+// optionally flipping a random bit per -corrupt-rate so the receiver's
+// CRC validation path can itself be exercised.
+func writeFramedLoop(conn net.Conn, wg *sync.WaitGroup) {
 
 	cinfo := fmt.Sprintf("[%s->%s] Output:", conn.RemoteAddr(), conn.LocalAddr())
-	var sent uint64
 
 	defer wg.Done()
 
-	output := bufio.NewWriter(conn)
+	frameSize := int(*frameSizeFlag)
+	if frameSize <= 0 || frameSize > len(netOutputData) {
+		frameSize = len(netOutputData)
+	}
+
+	header := make([]byte, frameHeaderSize)
+	var sent uint64
+	mw := &meteredWriter{Writer: conn}
 
 	start := time.Now()
+
 WRITE:
 	for {
-		n, err := output.Write(netOutputData)
-		if err == io.EOF {
-			// This is ok, but unlikely - 'broken pipe' is more likely.
-			vprintf("%s Received EOF\n", cinfo)
-			break
-		} else if err != nil {
-			// 'Broken pipe' is the most likely error here. Handle it specially.
-			switch err := err.(type) {
-			case *net.OpError:
-				// Ugly string match.
-				if fmt.Sprint(err.Err) == "write: broken pipe" {
-					vprintf("%s Remote closed the connection", cinfo)
-					break WRITE
-				}
+		for off := 0; off < len(netOutputData); off += frameSize {
+			end := off + frameSize
+			if end > len(netOutputData) {
+				end = len(netOutputData)
+			}
+
+			payload := append([]byte(nil), netOutputData[off:end]...)
+
+			binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+			binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(payload, crc32cTable))
+
+			if *corruptRateFlag > 0 && len(payload) > 0 && rand.Float64() < *corruptRateFlag {
+				payload[rand.Intn(len(payload))] ^= 1 << uint(rand.Intn(8))
+			}
+
+			if err := writeFrame(mw, cinfo, header, payload); err != nil {
+				break WRITE
 			}
-			// Ok, this really is an unexpected error.
+			sent += uint64(len(header) + len(payload))
+		}
+	}
+
+	elapsed := time.Since(start)
+	rate := 1000.0 * float64(sent) / float64(elapsed)
+
+	iprintf("%s Sent %s in %s (%.3f MBps)", cinfo, maybeHumanBytes(sent), elapsed, rate)
+}
+
+// writeFrame writes a single frame's header then payload, reporting (and
+// classifying) any write error the same way the raw streaming path does.
+func writeFrame(w io.Writer, cinfo string, header, payload []byte) error {
+	for _, buf := range [][]byte{header, payload} {
+		if _, err := w.Write(buf); err != nil {
+			if writeErrorKind(err) == "broken_pipe" {
+				vprintf("%s Remote closed the connection", cinfo)
+			} else {
+				fmt.Fprintf(os.Stderr, "%s error: %s\n", cinfo, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func writeLoop(conn net.Conn, wg *sync.WaitGroup) {
+
+	if *sendFileFlag {
+		sendFileLoop(conn, wg)
+		return
+	}
+
+	if *framedFlag {
+		writeFramedLoop(conn, wg)
+		return
+	}
+
+	cinfo := fmt.Sprintf("[%s->%s] Output:", conn.RemoteAddr(), conn.LocalAddr())
+
+	defer wg.Done()
+
+	buf := getPooledBuffer()
+	defer putPooledBuffer(buf)
+
+	start := time.Now()
+
+	mw := &meteredWriter{Writer: conn}
+	sent, err := io.CopyBuffer(mw, &repeatingReader{data: netOutputData}, buf)
+	if err != nil {
+		// 'Broken pipe' is the most likely error here. Handle it specially.
+		if writeErrorKind(err) == "broken_pipe" {
+			vprintf("%s Remote closed the connection", cinfo)
+		} else {
 			fmt.Fprintf(os.Stderr, "%s error: %s\n", cinfo, err)
-			break
 		}
-		sent += uint64(n)
-		vprintf("%s Wrote %d bytes\n", cinfo, n)
 	}
 
 	elapsed := time.Since(start)
@@ -213,16 +610,27 @@ WRITE:
 	// => multiply by 10^3.
 	rate := 1000.0 * float64(sent) / float64(elapsed)
 
-	iprintf("%s Sent %s in %s (%.3f MBps)", cinfo, maybeHumanBytes(sent), elapsed, rate)
+	iprintf("%s Sent %s in %s (%.3f MBps)", cinfo, maybeHumanBytes(uint64(sent)), elapsed, rate)
 
 }
 
 func acceptHandler(conn net.Conn) {
 
+	conn = toxic.NewLimitedConn(conn, toxic.Options{
+		RateLimit: *rateLimitFlag,
+		Latency:   *latencyFlag,
+		Jitter:    *jitterFlag,
+	})
+
+	acceptedAt := time.Now()
+	activeConnections.Inc()
+
 	cinfo := fmt.Sprintf("%s->%s", conn.RemoteAddr(), conn.LocalAddr())
 	defer func() {
 		iprintf("[%s] Closing connection", cinfo)
 		conn.Close()
+		activeConnections.Dec()
+		connectionDurationSeconds.Observe(time.Since(acceptedAt).Seconds())
 	}()
 
 	var wg sync.WaitGroup
@@ -230,11 +638,12 @@ func acceptHandler(conn net.Conn) {
 	// Reader side.
 	if !*receiveFlag {
 		if *halfClose {
-			// We fully expect conn's concrete type to be *net.TCPConn.
+			// We expect conn to be a *net.TCPConn, or a toxic-wrapped one -
+			// either way it's whatever exposes CloseRead().
 			switch conn := conn.(type) {
-			case *net.TCPConn:
+			case interface{ CloseRead() error }:
 				vprintf("[%s] Input: Closing socket for read", cinfo)
-				err := (*conn).CloseRead()
+				err := conn.CloseRead()
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "[%s] Input: CloseRead(): %s", err)
 				}
@@ -249,9 +658,9 @@ func acceptHandler(conn net.Conn) {
 	if !*sendFlag {
 		if *halfClose {
 			switch conn := conn.(type) {
-			case *net.TCPConn:
+			case interface{ CloseWrite() error }:
 				vprintf("[%s] Output: Closing socket for write", cinfo)
-				err := (*conn).CloseWrite()
+				err := conn.CloseWrite()
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "[%s] Output: CloseWrite(): %s", err)
 				}
@@ -265,10 +674,24 @@ func acceptHandler(conn net.Conn) {
 	wg.Wait()
 }
 
+// listen dispatches to the listener for *protoFlag. It never returns.
 func listen() {
+	switch *protoFlag {
+	case "tcp":
+		listenTCP()
+	case "udp":
+		listenUDP()
+	case "quic":
+		listenQUIC()
+	default:
+		log.Fatalf("Unknown -proto %q: must be one of tcp, udp, quic", *protoFlag)
+	}
+}
+
+func listenTCP() {
 
 	laddr := fmt.Sprintf("%s:%v", *listenAddr, *listenPort)
-	iprintf("Listening on %s\n", laddr)
+	iprintf("Listening on tcp %s\n", laddr)
 	listener, err := net.Listen("tcp", laddr)
 
 	if err != nil {
@@ -286,6 +709,203 @@ func listen() {
 	}
 }
 
+// udpFlow tracks read/write byte counters for one source address, and is
+// reaped once no datagram has arrived from it for *udpIdleTimeout.
+type udpFlow struct {
+	addr     net.Addr
+	start    time.Time
+	received uint64
+	sent     uint64
+	seen     chan struct{}
+	done     chan struct{}
+}
+
+func (f *udpFlow) touch() {
+	select {
+	case f.seen <- struct{}{}:
+	default:
+		// A reset is already pending; dropping this one is fine.
+	}
+}
+
+func (f *udpFlow) report() {
+	elapsed := time.Since(f.start)
+	received := atomic.LoadUint64(&f.received)
+	sent := atomic.LoadUint64(&f.sent)
+	rate := 1000.0 * float64(received+sent) / float64(elapsed)
+	iprintf("[%s] UDP flow idle after %s: received %s, sent %s (%.3f MBps combined)",
+		f.addr, elapsed, maybeHumanBytes(received), maybeHumanBytes(sent), rate)
+}
+
+// idleReaper watches for activity on the flow, resetting an idle timer on
+// every touch(), and removes the flow from flows and closes done once it
+// has gone quiet for *udpIdleTimeout.
+func (f *udpFlow) idleReaper(flows *sync.Map, key string) {
+	timer := time.NewTimer(*udpIdleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-f.seen:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(*udpIdleTimeout)
+		case <-timer.C:
+			flows.Delete(key)
+			close(f.done)
+			activeConnections.Dec()
+			connectionDurationSeconds.Observe(time.Since(f.start).Seconds())
+			f.report()
+			return
+		}
+	}
+}
+
+// udpWriteFlow feeds netOutputData to addr until the flow is reaped by
+// idleReaper, mirroring writeLoop's "just keep sending" behaviour.
+func udpWriteFlow(pconn net.PacketConn, flow *udpFlow) {
+	for {
+		select {
+		case <-flow.done:
+			return
+		default:
+		}
+		n, err := pconn.WriteTo(netOutputData, flow.addr)
+		if n > 0 {
+			atomic.AddUint64(&flow.sent, uint64(n))
+			bytesSentTotal.Add(float64(n))
+		}
+		if err != nil {
+			writeErrorsTotal.WithLabelValues(writeErrorKind(err)).Inc()
+			fmt.Fprintf(os.Stderr, "[%s] UDP write error: %s\n", flow.addr, err)
+			return
+		}
+	}
+}
+
+// listenUDP selects the transport by reading datagrams on a single
+// socket and demultiplexing by source address into per-flow byte
+// counters, since UDP has no notion of an accepted connection.
+func listenUDP() {
+
+	laddr := fmt.Sprintf("%s:%v", *listenAddr, *listenPort)
+	iprintf("Listening on udp %s\n", laddr)
+	pconn, err := net.ListenPacket("udp", laddr)
+	if err != nil {
+		log.Fatalf("Couldn't open UDP listen socket for %s: %s", laddr, err)
+	}
+	defer pconn.Close()
+
+	var flows sync.Map // net.Addr.String() -> *udpFlow
+
+	buf := make([]byte, (*blockSizeKilobytes)*1024)
+	for {
+		n, addr, err := pconn.ReadFrom(buf)
+		if err != nil {
+			log.Fatalf("ReadFrom() failed: %s", err)
+		}
+
+		key := addr.String()
+		flowIface, loaded := flows.Load(key)
+		if !loaded {
+			flow := &udpFlow{addr: addr, start: time.Now(), seen: make(chan struct{}, 1), done: make(chan struct{})}
+			flows.Store(key, flow)
+			iprintf("Accepted UDP flow from %s\n", addr)
+			activeConnections.Inc()
+			go flow.idleReaper(&flows, key)
+			if *sendFlag {
+				go udpWriteFlow(pconn, flow)
+			}
+			flowIface = flow
+		}
+
+		flow := flowIface.(*udpFlow)
+		if *receiveFlag {
+			atomic.AddUint64(&flow.received, uint64(n))
+			bytesReceivedTotal.Add(float64(n))
+		}
+		flow.touch()
+	}
+}
+
+// quicStreamConn adapts a quic.Stream to net.Conn by adding the
+// LocalAddr/RemoteAddr that readLoop/writeLoop expect but a stream, being
+// multiplexed over a single *quic.Conn, doesn't carry itself.
+type quicStreamConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (c *quicStreamConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *quicStreamConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// quicSelfSignedTLSConfig builds an ephemeral self-signed certificate so
+// -proto quic works out of the box for benchmarking, the same way the
+// other transports need no certificate setup.
+func quicSelfSignedTLSConfig() (*tls.Config, error) {
+	key, err := rsa.GenerateKey(cryptorand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("generating key: %w", err)
+	}
+
+	template := x509.Certificate{SerialNumber: big.NewInt(1)}
+	certDER, err := x509.CreateCertificate(cryptorand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("creating certificate: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("building keypair: %w", err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"netnull"}}, nil
+}
+
+// acceptQUICConn accepts every stream multiplexed over conn and hands
+// each to acceptHandler, exactly like a freshly-accepted TCP connection.
+func acceptQUICConn(conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			vprintf("[%s] QUIC connection closed: %s", conn.RemoteAddr(), err)
+			return
+		}
+		iprintf("Accepted QUIC stream from %s\n", conn.RemoteAddr())
+		go acceptHandler(&quicStreamConn{Stream: stream, conn: conn})
+	}
+}
+
+// listenQUIC reuses readLoop/writeLoop unchanged: once a stream is
+// accepted it satisfies net.Conn just like a TCP or UDP connection does.
+func listenQUIC() {
+
+	laddr := fmt.Sprintf("%s:%v", *listenAddr, *listenPort)
+	iprintf("Listening on quic %s\n", laddr)
+
+	tlsConf, err := quicSelfSignedTLSConfig()
+	if err != nil {
+		log.Fatalf("Couldn't build TLS config for QUIC: %s", err)
+	}
+
+	listener, err := quic.ListenAddr(laddr, tlsConf, nil)
+	if err != nil {
+		log.Fatalf("Couldn't open QUIC listen socket for %s: %s", laddr, err)
+	}
+
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			log.Fatalf("QUIC Accept() failed: %s", err)
+		}
+		iprintf("Accepted QUIC connection from %s\n", conn.RemoteAddr())
+		go acceptQUICConn(conn)
+	}
+}
+
 func main() {
 	flag.Parse()
 
@@ -293,11 +913,26 @@ func main() {
 		log.Fatalf("You must use at least one of -send and -receive!")
 	}
 
+	if *sendFileFlag {
+		if !*sendFlag {
+			log.Fatalf("-sendfile requires -send")
+		}
+		if *sendFilePath == "" {
+			log.Fatalf("-sendfile requires -send-file <path>")
+		}
+	}
+
+	if *blockSizeKilobytes == 0 {
+		log.Fatalf("-blocksize must be at least 1")
+	}
+
 	netOutputData = make([]byte, (*blockSizeKilobytes)*1024)
 
 	if *listenAddr == "*" {
 		*listenAddr = "0.0.0.0" // XXX Assumes IPv4.
 	}
 
+	serveMetrics()
+
 	listen() // Never returns.
 }
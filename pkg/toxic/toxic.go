@@ -0,0 +1,211 @@
+// Package toxic wraps a net.Conn with rate limiting and latency
+// injection, turning netnull into a lightweight network-condition
+// simulator for exercising timeout logic, congestion behaviour and
+// slow-loris-style scenarios without an external proxy like toxiproxy.
+package toxic
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// refillsPerSecond governs how often a token bucket tops up - a higher
+// rate gives smoother shaping at the cost of more ticker wakeups.
+const refillsPerSecond = 10
+
+// Options configures the toxics NewLimitedConn applies to a connection.
+type Options struct {
+	// RateLimit caps throughput in bytes/sec, independently for reads and
+	// writes. Zero disables rate limiting.
+	RateLimit uint64
+	// Burst is the token bucket capacity in bytes. Zero defaults to
+	// RateLimit, i.e. one second's worth of burst.
+	Burst uint64
+	// Latency is the fixed delay added before every write.
+	Latency time.Duration
+	// Jitter is a random +/- delta applied on top of Latency.
+	Jitter time.Duration
+}
+
+func (o Options) enabled() bool {
+	return o.RateLimit > 0 || o.Latency > 0 || o.Jitter > 0
+}
+
+// NewLimitedConn wraps conn so that reads and writes are subject to the
+// rate limiting and latency injection described by opts. A zero Options
+// returns conn unchanged.
+func NewLimitedConn(conn net.Conn, opts Options) net.Conn {
+	if !opts.enabled() {
+		return conn
+	}
+
+	lc := &limitedConn{Conn: conn, latency: opts.Latency, jitter: opts.Jitter}
+
+	if opts.RateLimit > 0 {
+		burst := opts.Burst
+		if burst == 0 {
+			burst = opts.RateLimit
+		}
+		lc.readBucket = newTokenBucket(opts.RateLimit, burst)
+		lc.writeBucket = newTokenBucket(opts.RateLimit, burst)
+	}
+
+	return lc
+}
+
+type limitedConn struct {
+	net.Conn
+	readBucket  *tokenBucket
+	writeBucket *tokenBucket
+	latency     time.Duration
+	jitter      time.Duration
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if c.readBucket != nil {
+		p = c.readBucket.take(p)
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	c.delay()
+
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if c.writeBucket != nil {
+			chunk = c.writeBucket.take(p)
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// halfCloseReader and halfCloseWriter mirror the CloseRead/CloseWrite
+// methods *net.TCPConn exposes for -halfclose. limitedConn forwards to
+// them so wrapping a connection in toxics doesn't silently disable
+// half-close support.
+type halfCloseReader interface {
+	CloseRead() error
+}
+
+type halfCloseWriter interface {
+	CloseWrite() error
+}
+
+func (c *limitedConn) CloseRead() error {
+	if cr, ok := c.Conn.(halfCloseReader); ok {
+		return cr.CloseRead()
+	}
+	return nil
+}
+
+func (c *limitedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(halfCloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *limitedConn) Close() error {
+	if c.readBucket != nil {
+		c.readBucket.stop()
+	}
+	if c.writeBucket != nil {
+		c.writeBucket.stop()
+	}
+	return c.Conn.Close()
+}
+
+func (c *limitedConn) delay() {
+	if c.latency == 0 && c.jitter == 0 {
+		return
+	}
+	d := c.latency
+	if c.jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(2*c.jitter))) - c.jitter
+		if d < 0 {
+			d = 0
+		}
+	}
+	time.Sleep(d)
+}
+
+// tokenBucket is a leaky-bucket rate limiter: tokens (bytes) are added by
+// a time.Ticker up to capacity, and take() blocks until at least one
+// token is available.
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   uint64
+	capacity uint64
+	perTick  uint64
+	ticker   *time.Ticker
+	done     chan struct{}
+}
+
+func newTokenBucket(rate, capacity uint64) *tokenBucket {
+	perTick := rate / refillsPerSecond
+	if perTick == 0 {
+		perTick = 1
+	}
+
+	tb := &tokenBucket{
+		tokens:   capacity,
+		capacity: capacity,
+		perTick:  perTick,
+		ticker:   time.NewTicker(time.Second / refillsPerSecond),
+		done:     make(chan struct{}),
+	}
+
+	go tb.refill()
+
+	return tb
+}
+
+func (tb *tokenBucket) refill() {
+	for {
+		select {
+		case <-tb.ticker.C:
+			tb.mu.Lock()
+			tb.tokens += tb.perTick
+			if tb.tokens > tb.capacity {
+				tb.tokens = tb.capacity
+			}
+			tb.mu.Unlock()
+		case <-tb.done:
+			return
+		}
+	}
+}
+
+// take returns the longest prefix of p payable with the tokens
+// currently available, blocking until at least one token has accrued.
+func (tb *tokenBucket) take(p []byte) []byte {
+	for {
+		tb.mu.Lock()
+		if tb.tokens > 0 {
+			n := uint64(len(p))
+			if n > tb.tokens {
+				n = tb.tokens
+			}
+			tb.tokens -= n
+			tb.mu.Unlock()
+			return p[:n]
+		}
+		tb.mu.Unlock()
+		time.Sleep(time.Second / refillsPerSecond)
+	}
+}
+
+func (tb *tokenBucket) stop() {
+	tb.ticker.Stop()
+	close(tb.done)
+}